@@ -0,0 +1,217 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HTTPBasicAuth carries HTTP basic-auth credentials for CloneWithOptions.
+type HTTPBasicAuth struct {
+	Username string
+	Password string
+}
+
+// gitAuth is the environment and remote-URL rewriting execBackend needs in
+// order to authenticate against a CloneOptions-configured remote, plus a
+// cleanup func for any temp files it created along the way. Config values
+// are passed via the GIT_CONFIG_COUNT/GIT_CONFIG_KEY_n/GIT_CONFIG_VALUE_n
+// environment variables (supported since git 2.31) rather than "git -c",
+// so that secrets never appear in the child process's argv.
+type gitAuth struct {
+	env     []string
+	remote  string
+	cleanup func()
+}
+
+// prepareAuth materializes any credentials configured in opts for the exec
+// backend and returns the resulting gitAuth. Callers must invoke the
+// returned gitAuth's cleanup exactly once. On error, prepareAuth removes
+// any temp files it already created itself and returns a nil gitAuth.
+func prepareAuth(remote string, opts CloneOptions) (*gitAuth, error) {
+	auth := &gitAuth{remote: remote, cleanup: func() {}}
+
+	if len(opts.SSHPrivateKey) != 0 {
+		if err := auth.addSSHKey(opts); err != nil {
+			auth.cleanup()
+			return nil, err
+		}
+	}
+
+	if opts.HTTPBasicAuth != nil {
+		if err := auth.addBasicAuth(*opts.HTTPBasicAuth); err != nil {
+			auth.cleanup()
+			return nil, err
+		}
+	}
+
+	if opts.HTTPBearerToken != "" {
+		auth.addConfig(bearerConfigKey(remote), "Authorization: Bearer "+opts.HTTPBearerToken)
+	}
+
+	if opts.NetrcPath != "" {
+		if err := auth.addNetrc(opts.NetrcPath); err != nil {
+			auth.cleanup()
+			return nil, err
+		}
+	}
+
+	return auth, nil
+}
+
+func (a *gitAuth) addSSHKey(opts CloneOptions) error {
+	keyFile, err := writeTempSecret("docker-build-git-key", opts.SSHPrivateKey)
+	if err != nil {
+		return err
+	}
+	a.chain(func() { removeTempSecret(keyFile) })
+
+	knownHostsFlag := "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
+	if len(opts.SSHKnownHosts) != 0 {
+		knownHostsFile, err := writeTempSecret("docker-build-git-known-hosts", opts.SSHKnownHosts)
+		if err != nil {
+			return err
+		}
+		a.chain(func() { removeTempSecret(knownHostsFile) })
+		knownHostsFlag = "-o StrictHostKeyChecking=yes -o UserKnownHostsFile=" + knownHostsFile
+	}
+
+	a.env = append(a.env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s %s", keyFile, knownHostsFlag))
+	if opts.SSHPassphrase != "" {
+		// DOCKER_GIT_SSH_PASSPHRASE isn't read by git itself; it exists
+		// purely so an askpass helper configured via GIT_SSH_COMMAND could
+		// read it back out without the passphrase ever touching argv. We
+		// don't ship such a helper yet, so for now an encrypted key without
+		// an external askpass script simply won't unlock.
+		a.env = append(a.env, "DOCKER_GIT_SSH_PASSPHRASE="+opts.SSHPassphrase)
+	}
+	return nil
+}
+
+func (a *gitAuth) addBasicAuth(creds HTTPBasicAuth) error {
+	u, err := url.Parse(a.remote)
+	if err != nil {
+		return err
+	}
+	// Only set the username on the remote URL; leaving the password out of
+	// it (and out of argv) means git's credential matching still narrows to
+	// this username, and the password is only ever handed over by the
+	// inline helper below, read from the environment.
+	u.User = url.User(creds.Username)
+	a.remote = u.String()
+
+	a.env = append(a.env, "DOCKER_GIT_BASIC_AUTH_PASSWORD="+creds.Password)
+	a.addConfig("credential.helper", `!f() { echo password=$DOCKER_GIT_BASIC_AUTH_PASSWORD; }; f`)
+	return nil
+}
+
+func (a *gitAuth) addNetrc(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// git's http transport only enables curl's CURLOPT_NETRC, never sets
+	// CURLOPT_NETRC_FILE, so curl always falls back to $HOME/.netrc; a
+	// NETRC env var is silently ignored. Materialize the netrc at
+	// <tempdir>/.netrc and point HOME at tempdir instead, the same way
+	// BuildKit does it.
+	netrcFile, err := writeTempSecretNamed("docker-build-git-netrc", ".netrc", contents)
+	if err != nil {
+		return err
+	}
+	a.chain(func() { removeTempSecret(netrcFile) })
+	a.env = append(a.env, "HOME="+filepath.Dir(netrcFile))
+	return nil
+}
+
+// addConfig appends a GIT_CONFIG_KEY_n/GIT_CONFIG_VALUE_n pair to the
+// environment, bumping GIT_CONFIG_COUNT accordingly.
+func (a *gitAuth) addConfig(key, value string) {
+	n := 0
+	for _, e := range a.env {
+		if strings.HasPrefix(e, "GIT_CONFIG_COUNT=") {
+			n, _ = strconv.Atoi(strings.TrimPrefix(e, "GIT_CONFIG_COUNT="))
+		}
+	}
+	for i, e := range a.env {
+		if strings.HasPrefix(e, "GIT_CONFIG_COUNT=") {
+			a.env = append(a.env[:i], a.env[i+1:]...)
+			break
+		}
+	}
+	a.env = append(a.env,
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", n+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", n, key),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", n, value),
+	)
+}
+
+func (a *gitAuth) chain(fn func()) {
+	prev := a.cleanup
+	a.cleanup = func() { prev(); fn() }
+}
+
+func bearerConfigKey(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" {
+		return "http.extraheader"
+	}
+	return fmt.Sprintf("http.%s://%s/.extraheader", u.Scheme, u.Host)
+}
+
+// writeTempSecret writes contents to a new mode-0600 file named "secret"
+// under an owner-only (mode-0700) directory and returns its path. Both the directory and file
+// are removed by removeTempSecret.
+func writeTempSecret(prefix string, contents []byte) (string, error) {
+	return writeTempSecretNamed(prefix, "secret", contents)
+}
+
+// writeTempSecretNamed is writeTempSecret with a caller-chosen file name
+// instead of "secret", for callers like addNetrc that need a specific
+// name (".netrc") for the file to be picked up by another tool.
+func writeTempSecretNamed(prefix, name string, contents []byte) (string, error) {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		return "", err
+	}
+	if err := chmod600(dir); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// redactSecrets replaces any credential configured in opts that appears in
+// s with "***", so secrets echoed back by a failing git command don't end
+// up in a wrapped error (and, from there, in logs).
+func redactSecrets(s string, opts CloneOptions) string {
+	if opts.HTTPBasicAuth != nil && opts.HTTPBasicAuth.Password != "" {
+		s = strings.ReplaceAll(s, opts.HTTPBasicAuth.Password, "***")
+	}
+	if opts.HTTPBearerToken != "" {
+		s = strings.ReplaceAll(s, opts.HTTPBearerToken, "***")
+	}
+	if opts.SSHPassphrase != "" {
+		s = strings.ReplaceAll(s, opts.SSHPassphrase, "***")
+	}
+	return s
+}
+
+// removeTempSecret removes a file created by writeTempSecret along with
+// its containing directory.
+func removeTempSecret(path string) {
+	os.RemoveAll(filepath.Dir(path))
+}
+
+// chmod600 locks a temp directory down to the owner only, so secrets
+// written underneath it aren't world- or group-readable even briefly.
+func chmod600(dir string) error {
+	return os.Chmod(dir, 0700)
+}
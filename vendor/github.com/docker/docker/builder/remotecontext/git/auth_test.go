@@ -0,0 +1,143 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	cases := []struct {
+		name string
+		opts CloneOptions
+		in   string
+		want string
+	}{
+		{
+			name: "basic auth password",
+			opts: CloneOptions{HTTPBasicAuth: &HTTPBasicAuth{Username: "u", Password: "s3cr3t"}},
+			in:   "remote: Invalid credentials for s3cr3t",
+			want: "remote: Invalid credentials for ***",
+		},
+		{
+			name: "bearer token",
+			opts: CloneOptions{HTTPBearerToken: "tok-abc"},
+			in:   "fatal: Authorization: Bearer tok-abc rejected",
+			want: "fatal: Authorization: Bearer *** rejected",
+		},
+		{
+			name: "ssh passphrase",
+			opts: CloneOptions{SSHPassphrase: "hunter2"},
+			in:   "Enter passphrase for key: hunter2: bad passphrase",
+			want: "Enter passphrase for key: ***: bad passphrase",
+		},
+		{
+			name: "nothing configured leaves output untouched",
+			opts: CloneOptions{},
+			in:   "fatal: repository not found",
+			want: "fatal: repository not found",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := redactSecrets(tc.in, tc.opts); got != tc.want {
+				t.Errorf("redactSecrets(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrepareAuthBasicAuthPasswordInEnvNotRemote(t *testing.T) {
+	auth, err := prepareAuth("https://example.com/repo.git", CloneOptions{
+		HTTPBasicAuth: &HTTPBasicAuth{Username: "alice", Password: "s3cr3t"},
+	})
+	if err != nil {
+		t.Fatalf("prepareAuth: %v", err)
+	}
+	defer auth.cleanup()
+
+	if strings.Contains(auth.remote, "s3cr3t") {
+		t.Errorf("remote %q leaks the password; the password must only travel via env", auth.remote)
+	}
+	if !strings.Contains(auth.remote, "alice@") {
+		t.Errorf("remote %q should carry the username for credential matching", auth.remote)
+	}
+
+	found := false
+	for _, e := range auth.env {
+		if e == "DOCKER_GIT_BASIC_AUTH_PASSWORD=s3cr3t" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected DOCKER_GIT_BASIC_AUTH_PASSWORD in env, got %v", auth.env)
+	}
+}
+
+func TestPrepareAuthSSHKeyWrittenAndCleanedUp(t *testing.T) {
+	auth, err := prepareAuth("git@example.com:org/repo.git", CloneOptions{
+		SSHPrivateKey: []byte("fake-key-material"),
+	})
+	if err != nil {
+		t.Fatalf("prepareAuth: %v", err)
+	}
+
+	var keyFile string
+	for _, e := range auth.env {
+		if strings.HasPrefix(e, "GIT_SSH_COMMAND=ssh -i ") {
+			fields := strings.Fields(strings.TrimPrefix(e, "GIT_SSH_COMMAND=ssh -i "))
+			if len(fields) == 0 {
+				t.Fatalf("malformed GIT_SSH_COMMAND: %s", e)
+			}
+			keyFile = fields[0]
+		}
+	}
+	if keyFile == "" {
+		t.Fatalf("expected GIT_SSH_COMMAND in env, got %v", auth.env)
+	}
+	if _, err := os.Stat(keyFile); err != nil {
+		t.Fatalf("expected key file %s to exist: %v", keyFile, err)
+	}
+
+	auth.cleanup()
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Errorf("expected key file %s to be removed after cleanup, stat err = %v", keyFile, err)
+	}
+}
+
+func TestPrepareAuthNetrcSetsHOMENotNETRC(t *testing.T) {
+	netrcPath := filepath.Join(t.TempDir(), "netrc")
+	contents := "machine example.com\nlogin alice\npassword s3cr3t\n"
+	if err := os.WriteFile(netrcPath, []byte(contents), 0600); err != nil {
+		t.Fatalf("writing source netrc: %v", err)
+	}
+
+	auth, err := prepareAuth("https://example.com/repo.git", CloneOptions{NetrcPath: netrcPath})
+	if err != nil {
+		t.Fatalf("prepareAuth: %v", err)
+	}
+	defer auth.cleanup()
+
+	var home string
+	for _, e := range auth.env {
+		if strings.HasPrefix(e, "NETRC=") {
+			t.Errorf("NETRC is ignored by git's http transport; got %s in env", e)
+		}
+		if strings.HasPrefix(e, "HOME=") {
+			home = strings.TrimPrefix(e, "HOME=")
+		}
+	}
+	if home == "" {
+		t.Fatalf("expected HOME in env, got %v", auth.env)
+	}
+
+	got, err := os.ReadFile(filepath.Join(home, ".netrc"))
+	if err != nil {
+		t.Fatalf("reading %s/.netrc: %v", home, err)
+	}
+	if string(got) != contents {
+		t.Errorf(".netrc contents = %q, want %q", got, contents)
+	}
+}
@@ -0,0 +1,332 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// Default timeouts applied by CloneContextWithOptions when the
+// corresponding CloneOptions field is left at its zero value.
+const (
+	DefaultProbeTimeout    = 5 * time.Second
+	DefaultFetchTimeout    = 5 * time.Minute
+	DefaultCheckoutTimeout = 2 * time.Minute
+)
+
+// Backend performs the init/fetch/checkout work behind Clone and
+// CloneWithOptions. execBackend (the default, used by Clone for backwards
+// compatibility) shells out to the system "git" binary; goGitBackend does
+// the same steps in-process with go-git.
+type Backend interface {
+	// Clone fetches repo.remote at repo.ref into a newly created temporary
+	// directory and returns the path to use as the build context, resolving
+	// repo.subdir the same way checkoutGit always has. opts carries any
+	// credentials the Backend should authenticate with. ctx bounds the
+	// whole operation, including any HTTP probing the Backend does.
+	Clone(ctx context.Context, repo gitRepo, opts CloneOptions) (string, error)
+}
+
+// CloneOptions configures CloneWithOptions. The zero value reproduces the
+// behavior of Clone.
+type CloneOptions struct {
+	// Backend selects the git implementation used to perform the clone. If
+	// nil, execBackend is used for parity with Clone.
+	Backend Backend
+
+	// SSHPrivateKey, if set, is used to authenticate an ssh:// or git@
+	// remote. It's materialized into a mode-0600 temp file for the
+	// lifetime of the clone and removed before CloneWithOptions returns.
+	SSHPrivateKey []byte
+	// SSHPassphrase is exported to the git child process as
+	// DOCKER_GIT_SSH_PASSPHRASE and redacted from error output. Nothing in
+	// this package feeds it to ssh, so an encrypted SSHPrivateKey is not
+	// unlocked by it.
+	SSHPassphrase string
+	// SSHKnownHosts, if set, pins the host keys accepted for SSHPrivateKey
+	// auth instead of disabling host key checking.
+	SSHKnownHosts []byte
+
+	// HTTPBasicAuth, if set, authenticates an https:// remote with a
+	// username and password.
+	HTTPBasicAuth *HTTPBasicAuth
+	// HTTPBearerToken, if set, authenticates an https:// remote with a
+	// bearer token, e.g. a GitHub/GitLab access token.
+	HTTPBearerToken string
+
+	// NetrcPath, if set, points at a netrc file to use for resolving
+	// credentials instead of (or in addition to) the options above.
+	NetrcPath string
+
+	// KeepGitDir, if set, leaves the .git directory in place in the
+	// returned build context instead of stripping it, so downstream
+	// tooling (e.g. "git describe", embedding build metadata) can use it.
+	KeepGitDir bool
+
+	// ExpectedCommit, if set, pins the clone to a specific commit SHA: once
+	// checked out, HEAD must resolve to exactly this commit or Clone fails.
+	// This is independent of the ref being fetched, so a caller can fetch a
+	// mutable ref (e.g. refs/pull/42/head) while still refusing to build
+	// against anything but a known-good commit.
+	ExpectedCommit string
+
+	// ProbeTimeout bounds the HEAD request and any GET fallback, taken
+	// together, that supportsShallowClone makes to decide whether a remote's
+	// smart-HTTP endpoint is reachable. Defaults to DefaultProbeTimeout.
+	ProbeTimeout time.Duration
+	// FetchTimeout bounds the "git fetch" step (including its SHA-pinning
+	// fallback). Defaults to DefaultFetchTimeout.
+	FetchTimeout time.Duration
+	// CheckoutTimeout bounds the "git checkout" step. Defaults to
+	// DefaultCheckoutTimeout.
+	CheckoutTimeout time.Duration
+
+	// Cache, if set, makes execBackend fetch into (and check out from) a
+	// shared local mirror instead of doing a fresh init+fetch into a new
+	// temp dir on every call.
+	Cache *Cache
+	// Deepen keeps the mirror shallow across repeated fetches (via "git
+	// fetch --deepen") instead of the default of promoting it to full
+	// history as soon as more than one fetch has happened. Only consulted
+	// when Cache is set.
+	Deepen bool
+
+	// Submodules controls whether and how deep submodules are fetched and
+	// checked out. Defaults to SubmoduleRecursive for back-compat with
+	// Clone's long-standing "--recurse-submodules=yes" behavior.
+	Submodules SubmoduleMode
+	// LFS, if set, runs "git lfs install --local" and then "git lfs pull"
+	// after checkout, returning an error if git-lfs isn't on PATH rather
+	// than silently leaving LFS pointer files in place. Nothing LFS-related
+	// runs before the fetch.
+	LFS bool
+	// SparseCheckout, if non-empty, narrows the checked-out working tree
+	// to these patterns (written to .git/info/sparse-checkout), which both
+	// speeds up checkout and shrinks what subdir has to operate over.
+	SparseCheckout []string
+}
+
+// SubmoduleMode controls how deep CloneOptions.Submodules fetches and
+// checks out a repository's submodules.
+type SubmoduleMode int
+
+const (
+	// SubmoduleRecursive fetches and checks out submodules and their own
+	// submodules, recursively. It's the zero value so that a plain
+	// CloneOptions{} reproduces Clone's historical behavior.
+	SubmoduleRecursive SubmoduleMode = iota
+	// SubmoduleNone skips submodules entirely.
+	SubmoduleNone
+	// SubmoduleTop fetches and checks out only the top-level repository's
+	// direct submodules, without recursing into theirs.
+	SubmoduleTop
+)
+
+// CloneWithOptions clones a repository the same way Clone does, but lets
+// the caller opt into an alternate Backend (for example the go-git-based
+// one) and provide credentials, without changing Clone's signature.
+func CloneWithOptions(remoteURL string, opts CloneOptions) (string, error) {
+	return CloneContextWithOptions(context.Background(), remoteURL, opts)
+}
+
+// CloneContextWithOptions combines CloneContext's cancellation with
+// CloneWithOptions's Backend/credential selection.
+func CloneContextWithOptions(ctx context.Context, remoteURL string, opts CloneOptions) (string, error) {
+	repo, err := parseRemoteURL(remoteURL)
+	if err != nil {
+		return "", err
+	}
+
+	backend := opts.Backend
+	if backend == nil {
+		backend = &execBackend{}
+	}
+
+	return backend.Clone(ctx, repo, opts)
+}
+
+func withDefaultTimeout(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// execBackend is the default Backend. It runs the same init/fetch/checkout
+// steps with the system "git" binary as the pre-Backend Clone did, with
+// each step now bounded by the CloneOptions timeouts (or their defaults).
+type execBackend struct{}
+
+func (*execBackend) Clone(ctx context.Context, repo gitRepo, opts CloneOptions) (string, error) {
+	auth, err := prepareAuth(repo.remote, opts)
+	if err != nil {
+		return "", err
+	}
+	defer auth.cleanup()
+	repo.remote = auth.remote
+
+	if opts.Cache != nil {
+		return opts.Cache.checkout(ctx, repo, opts, auth.env)
+	}
+
+	probeTimeout := withDefaultTimeout(opts.ProbeTimeout, DefaultProbeTimeout)
+	fetch := fetchArgs(ctx, repo.remote, repo.ref, probeTimeout, opts.Submodules)
+
+	root, err := ioutil.TempDir("", "docker-build-git")
+	if err != nil {
+		return "", err
+	}
+
+	if out, err := gitWithinDir(ctx, root, "init"); err != nil {
+		return "", errors.Wrapf(err, "failed to init repo at %s: %s", root, out)
+	}
+
+	// Add origin remote for compatibility with previous implementation that
+	// used "git clone" and also to make sure local refs are created for branches
+	if out, err := gitWithinDirEnv(ctx, root, auth.env, "remote", "add", "origin", repo.remote); err != nil {
+		return "", errors.Wrapf(err, "failed add origin repo at %s: %s", redactSecrets(repo.remote, opts), redactSecrets(string(out), opts))
+	}
+
+	fetchCtx, cancelFetch := context.WithTimeout(ctx, withDefaultTimeout(opts.FetchTimeout, DefaultFetchTimeout))
+	defer cancelFetch()
+
+	if output, err := gitWithinDirEnv(fetchCtx, root, auth.env, fetch...); err != nil {
+		if !isFullCommitSHA(repo.ref) {
+			return "", errors.Wrapf(err, "error fetching: %s", redactSecrets(string(output), opts))
+		}
+
+		// Many servers reject "fetch origin <sha>" for an arbitrary commit
+		// unless they opt into uploadpack.allowReachableSHA1InWant (or
+		// allowAnySHA1InWant); fall back to fetching full history and
+		// resolving the SHA locally.
+		if fallbackOut, ferr := gitWithinDirEnv(fetchCtx, root, auth.env, "fetch", "origin"); ferr != nil {
+			return "", errors.Wrapf(ferr, "error fetching: %s (after shallow fetch of %s failed: %s)",
+				redactSecrets(string(fallbackOut), opts), repo.ref, redactSecrets(string(output), opts))
+		}
+	}
+
+	// checkoutGit bounds the checkout step itself by CheckoutTimeout and
+	// gives any submodule/LFS work its own, more generous budget; see
+	// finalizeCheckout.
+	return checkoutGit(ctx, root, repo.ref, repo.subdir, opts, auth.env)
+}
+
+// goGitBackend is a Backend built on github.com/go-git/go-git/v5. It
+// performs init/fetch/checkout entirely in-process, so it works against
+// hosts without a "git" binary installed.
+type goGitBackend struct{}
+
+// NewGoGitBackend returns the go-git-based Backend, for use as
+// CloneOptions.Backend.
+func NewGoGitBackend() Backend {
+	return &goGitBackend{}
+}
+
+func (*goGitBackend) Clone(ctx context.Context, repo gitRepo, opts CloneOptions) (string, error) {
+	if err := checkGoGitSupported(opts); err != nil {
+		return "", err
+	}
+
+	root, err := ioutil.TempDir("", "docker-build-git")
+	if err != nil {
+		return "", err
+	}
+
+	repository, err := git.PlainInit(root, false)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to init repo at %s", root)
+	}
+
+	remote, err := repository.CreateRemote(&config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repo.remote},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed add origin repo at %s", repo.remote)
+	}
+
+	fetchOpts := &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"+refs/*:refs/*"},
+	}
+	if supportsShallowClone(ctx, repo.remote, withDefaultTimeout(opts.ProbeTimeout, DefaultProbeTimeout)) {
+		fetchOpts.Depth = 1
+	}
+
+	fetchCtx, cancelFetch := context.WithTimeout(ctx, withDefaultTimeout(opts.FetchTimeout, DefaultFetchTimeout))
+	defer cancelFetch()
+
+	if err := remote.FetchContext(fetchCtx, fetchOpts); err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", errors.Wrapf(err, "error fetching: %s", repo.remote)
+	}
+
+	hash, err := resolveCheckoutHash(repository, repo.ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "error checking out %s", repo.ref)
+	}
+
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return "", err
+	}
+	if err := worktree.Checkout(&git.CheckoutOptions{Hash: hash}); err != nil {
+		return "", errors.Wrapf(err, "error checking out %s", repo.ref)
+	}
+
+	if want := pinnedCommit(repo.ref, opts); want != "" {
+		if got := hash.String(); got != want {
+			return "", errors.Errorf("checked out commit %s does not match expected commit %s", got, want)
+		}
+	}
+
+	if !opts.KeepGitDir {
+		if err := os.RemoveAll(filepath.Join(root, ".git")); err != nil {
+			return "", errors.Wrapf(err, "error removing .git at %s", root)
+		}
+	}
+
+	return applySubdir(root, repo.subdir)
+}
+
+// checkGoGitSupported rejects the CloneOptions fields goGitBackend can't
+// honor (credentials, Cache, LFS, and SparseCheckout), rather than silently
+// ignoring them the way it used to: a caller who asked for one of these
+// should get a clear error, not a clone that quietly skipped it.
+// ExpectedCommit and KeepGitDir aren't in this list because Clone does
+// implement them itself, above. Submodules and CheckoutTimeout are not
+// checked either: goGitBackend never fetches or checks out submodules,
+// whatever the mode, and its checkout step has no timeout.
+func checkGoGitSupported(opts CloneOptions) error {
+	switch {
+	case len(opts.SSHPrivateKey) != 0 || opts.HTTPBasicAuth != nil || opts.HTTPBearerToken != "" || opts.NetrcPath != "":
+		return errors.New("the go-git Backend does not support authenticated clones")
+	case opts.Cache != nil:
+		return errors.New("the go-git Backend does not support Cache")
+	case opts.LFS:
+		return errors.New("the go-git Backend does not support LFS")
+	case len(opts.SparseCheckout) != 0:
+		return errors.New("the go-git Backend does not support SparseCheckout")
+	}
+	return nil
+}
+
+// resolveCheckoutHash mirrors execBackend's "checkout by ref name, falling
+// back to FETCH_HEAD" behavior in terms go-git understands.
+func resolveCheckoutHash(repository *git.Repository, ref string) (plumbing.Hash, error) {
+	if hash, err := repository.ResolveRevision(plumbing.Revision(ref)); err == nil {
+		return *hash, nil
+	}
+
+	fetchHead, err := repository.Reference(plumbing.ReferenceName("FETCH_HEAD"), true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return fetchHead.Hash(), nil
+}
@@ -0,0 +1,71 @@
+package git
+
+import "testing"
+
+func TestPinnedCommit(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+
+	cases := []struct {
+		name string
+		ref  string
+		opts CloneOptions
+		want string
+	}{
+		{
+			name: "ExpectedCommit takes precedence over a mutable ref",
+			ref:  "refs/pull/42/head",
+			opts: CloneOptions{ExpectedCommit: sha},
+			want: sha,
+		},
+		{
+			name: "a full-SHA ref is pinned even without ExpectedCommit",
+			ref:  sha,
+			opts: CloneOptions{},
+			want: sha,
+		},
+		{
+			name: "a branch name with no ExpectedCommit isn't pinned",
+			ref:  "main",
+			opts: CloneOptions{},
+			want: "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pinnedCommit(tc.ref, tc.opts); got != tc.want {
+				t.Errorf("pinnedCommit(%q, %+v) = %q, want %q", tc.ref, tc.opts, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckGoGitSupported(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    CloneOptions
+		wantErr bool
+	}{
+		{name: "zero value is supported", opts: CloneOptions{}},
+		{name: "ExpectedCommit and KeepGitDir are supported", opts: CloneOptions{ExpectedCommit: "abc", KeepGitDir: true}},
+		{name: "SSH key is rejected", opts: CloneOptions{SSHPrivateKey: []byte("key")}, wantErr: true},
+		{name: "HTTP basic auth is rejected", opts: CloneOptions{HTTPBasicAuth: &HTTPBasicAuth{Username: "u", Password: "p"}}, wantErr: true},
+		{name: "HTTP bearer token is rejected", opts: CloneOptions{HTTPBearerToken: "tok"}, wantErr: true},
+		{name: "netrc is rejected", opts: CloneOptions{NetrcPath: "/tmp/netrc"}, wantErr: true},
+		{name: "Cache is rejected", opts: CloneOptions{Cache: &Cache{}}, wantErr: true},
+		{name: "LFS is rejected", opts: CloneOptions{LFS: true}, wantErr: true},
+		{name: "SparseCheckout is rejected", opts: CloneOptions{SparseCheckout: []string{"dir"}}, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkGoGitSupported(tc.opts)
+			if tc.wantErr && err == nil {
+				t.Errorf("checkGoGitSupported(%+v) = nil, want an error", tc.opts)
+			}
+			if !tc.wantErr && err != nil {
+				t.Errorf("checkGoGitSupported(%+v) = %v, want nil", tc.opts, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Cache maintains one bare mirror repository per remote under Dir, keyed
+// by the sha256 of the (normalized) remote URL, so that repeated Clone
+// calls against the same repo.remote only need to fetch incrementally
+// instead of doing a fresh init+fetch every time.
+type Cache struct {
+	// Dir is the directory mirrors are stored under.
+	Dir string
+}
+
+// NewCache returns a Cache rooted at the default cache directory,
+// os.UserCacheDir()/docker-build-git, creating it if necessary.
+func NewCache() (*Cache, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(base, "docker-build-git")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+func (c *Cache) mirrorPath(remote string) string {
+	sum := sha256.Sum256([]byte(remote))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:]))
+}
+
+// checkout fetches repo.remote into its mirror (creating it, or updating
+// it incrementally, as needed) and produces a fresh working tree for
+// repo.ref via "git worktree add", instead of execBackend's usual fresh
+// init+fetch into a new temp dir.
+func (c *Cache) checkout(ctx context.Context, repo gitRepo, opts CloneOptions, env []string) (string, error) {
+	mirror := c.mirrorPath(repo.remote)
+
+	root, err := ioutil.TempDir("", "docker-build-git")
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.fetch(ctx, mirror, repo, opts, env); err != nil {
+		return "", err
+	}
+
+	checkoutCtx, cancel := context.WithTimeout(ctx, withDefaultTimeout(opts.CheckoutTimeout, DefaultCheckoutTimeout))
+	defer cancel()
+
+	// Worktree creation isn't guarded by the mirror lock: git's own
+	// worktree administration (the mirror's worktrees/ directory) is
+	// safe for concurrent writers, so builds sharing a mirror only
+	// serialize on the network fetch, not on laying out their own copy.
+	// --no-checkout defers materializing files until after sparse-checkout
+	// (if any) is configured, the same ordering checkoutGit uses.
+	if out, err := gitBareEnv(checkoutCtx, mirror, env, "worktree", "add", "--detach", "--no-checkout", root, repo.ref); err != nil {
+		return "", errors.Wrapf(err, "error adding worktree for %s from mirror %s: %s", repo.ref, mirror, redactSecrets(string(out), opts))
+	}
+
+	if err := configureSparseCheckout(checkoutCtx, root, opts.SparseCheckout); err != nil {
+		return "", err
+	}
+
+	if out, err := gitWithinDir(checkoutCtx, root, "checkout", "--detach", repo.ref); err != nil {
+		return "", errors.Wrapf(err, "error checking out %s: %s", repo.ref, redactSecrets(string(out), opts))
+	}
+
+	return finalizeCheckout(ctx, root, repo.ref, repo.subdir, opts, env)
+}
+
+// fetch creates mirror as a bare mirror of repo.remote if it doesn't
+// already exist, then fetches repo.ref into it, serialized against other
+// callers targeting the same mirror via a flock on mirror+".lock".
+func (c *Cache) fetch(ctx context.Context, mirror string, repo gitRepo, opts CloneOptions, env []string) error {
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return err
+	}
+
+	unlock, err := lockPath(mirror + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fetchHead := filepath.Join(mirror, "FETCH_HEAD")
+	firstFetch := true
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		// --mirror=fetch sets up a "+refs/*:refs/*" fetch refspec, so any
+		// ref (branch, tag, or raw refs/pull/N/head) that checkoutGit-style
+		// resolution might need ends up available locally, not just the
+		// default branches.
+		if out, err := gitEnv(ctx, env, "init", "--bare", mirror); err != nil {
+			return errors.Wrapf(err, "failed to init mirror at %s: %s", mirror, redactSecrets(string(out), opts))
+		}
+		if out, err := gitBareEnv(ctx, mirror, env, "remote", "add", "--mirror=fetch", "origin", repo.remote); err != nil {
+			return errors.Wrapf(err, "failed to add origin to mirror at %s: %s", mirror, redactSecrets(string(out), opts))
+		}
+	} else if _, err := os.Stat(fetchHead); err == nil {
+		firstFetch = false
+	}
+
+	args := []string{"fetch"}
+	if opts.Submodules != SubmoduleNone {
+		args = append(args, "--recurse-submodules=yes")
+	}
+	switch {
+	case firstFetch:
+		// Same heuristic as a cache-less clone: try a shallow fetch if the
+		// remote supports it.
+		if supportsShallowClone(ctx, repo.remote, withDefaultTimeout(opts.ProbeTimeout, DefaultProbeTimeout)) {
+			args = append(args, "--depth", "1")
+		}
+	case !isShallowMirror(mirror):
+		// Already has full history; keep it that way.
+	case opts.Deepen:
+		args = append(args, "--deepen", "1")
+	default:
+		// A plain "fetch origin" with no depth flags does NOT promote an
+		// already-shallow mirror to full history; git only does that for
+		// "--unshallow". Ask for it explicitly so the mirror actually
+		// reaches full history on the second fetch, as Deepen's doc
+		// comment promises.
+		args = append(args, "--unshallow")
+	}
+	args = append(args, "origin")
+
+	fetchCtx, cancel := context.WithTimeout(ctx, withDefaultTimeout(opts.FetchTimeout, DefaultFetchTimeout))
+	defer cancel()
+
+	if out, err := gitBareEnv(fetchCtx, mirror, env, args...); err != nil {
+		return errors.Wrapf(err, "error fetching into mirror %s: %s", mirror, redactSecrets(string(out), opts))
+	}
+	return nil
+}
+
+// isShallowMirror reports whether mirror (a bare repo) is currently a
+// shallow clone, i.e. it has a "shallow" file recording the fetch
+// boundary. A plain os.Stat is enough here since grafts/shallow files are
+// maintained by git itself, not raced by concurrent readers.
+func isShallowMirror(mirror string) bool {
+	_, err := os.Stat(filepath.Join(mirror, "shallow"))
+	return err == nil
+}
+
+// lockPath takes an exclusive advisory lock on path (creating it if
+// necessary) and returns a func to release it. It serializes concurrent
+// Cache.fetch calls against the same mirror without blocking unrelated
+// mirrors or worktree creation. The actual locking primitive is
+// platform-specific; see lockFile/unlockFile/tryLockFile in cache_unix.go
+// and cache_windows.go.
+func lockPath(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to lock %s", path)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// GC removes mirrors under c.Dir that haven't been fetched in more than
+// maxAge, then, if the cache is still over maxBytes, removes further
+// mirrors oldest-fetched-first until it's back under budget. maxBytes <= 0
+// disables the size-based pass.
+func (c *Cache) GC(maxAge time.Duration, maxBytes int64) error {
+	entries, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var mirrors []mirrorInfo
+	now := time.Now()
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue // skip *.lock files and anything else stray
+		}
+		mirror := filepath.Join(c.Dir, e.Name())
+		lastFetch, size, err := mirrorStat(mirror)
+		if err != nil {
+			continue
+		}
+		if now.Sub(lastFetch) > maxAge {
+			c.remove(mirror)
+			continue
+		}
+		mirrors = append(mirrors, mirrorInfo{path: mirror, lastFetch: lastFetch, size: size})
+	}
+
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	var total int64
+	for _, m := range mirrors {
+		total += m.size
+	}
+	if total <= maxBytes {
+		return nil
+	}
+
+	sort.Slice(mirrors, func(i, j int) bool { return mirrors[i].lastFetch.Before(mirrors[j].lastFetch) })
+	for _, m := range mirrors {
+		if total <= maxBytes {
+			break
+		}
+		if c.remove(m.path) {
+			total -= m.size
+		}
+	}
+	return nil
+}
+
+type mirrorInfo struct {
+	path      string
+	lastFetch time.Time
+	size      int64
+}
+
+// mirrorStat returns a mirror's last-fetch time (the mtime of its FETCH_HEAD,
+// falling back to the mirror dir itself for one that's never been fetched
+// into) and its total on-disk size.
+func mirrorStat(mirror string) (time.Time, int64, error) {
+	lastFetch := time.Time{}
+	if fi, err := os.Stat(filepath.Join(mirror, "FETCH_HEAD")); err == nil {
+		lastFetch = fi.ModTime()
+	} else if fi, err := os.Stat(mirror); err == nil {
+		lastFetch = fi.ModTime()
+	} else {
+		return time.Time{}, 0, err
+	}
+
+	var size int64
+	err := filepath.Walk(mirror, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return lastFetch, size, err
+}
+
+// remove best-effort deletes a mirror and its lock file, skipping ones
+// currently locked by an in-flight fetch rather than blocking on them. It
+// reports whether the mirror was removed rather than skipped.
+func (c *Cache) remove(mirror string) bool {
+	f, err := os.OpenFile(mirror+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	ok, err := tryLockFile(f)
+	if err != nil || !ok {
+		return false // in use, or couldn't tell; leave it for the next GC pass
+	}
+	defer unlockFile(f)
+
+	os.RemoveAll(mirror)
+	os.Remove(mirror + ".lock")
+	return true
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package git
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes a blocking exclusive flock on f.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// unlockFile releases a lock taken by lockFile or tryLockFile.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// tryLockFile attempts a non-blocking exclusive flock on f, returning
+// ok=false (with a nil error) if it's already held by another process
+// rather than blocking for it.
+func tryLockFile(f *os.File) (bool, error) {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,64 @@
+//go:build windows
+// +build windows
+
+package git
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Windows has no flock(2); LockFileEx/UnlockFileEx from kernel32 are the
+// same primitive golang.org/x/sys/windows wraps, so Cache's locking
+// behaves the same way cross-platform without adding that dependency.
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileExclusiveLock   = 0x00000002
+	lockfileFailImmediately = 0x00000001
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile takes a blocking exclusive lock on f.
+func lockFile(f *os.File) error {
+	return lockFileEx(f, lockfileExclusiveLock)
+}
+
+// unlockFile releases a lock taken by lockFile or tryLockFile.
+func unlockFile(f *os.File) error {
+	var overlapped syscall.Overlapped
+	r1, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r1 == 0 {
+		return err
+	}
+	return nil
+}
+
+// tryLockFile attempts a non-blocking exclusive lock on f, returning
+// ok=false (with a nil error) if it's already held by another process
+// rather than blocking for it.
+func tryLockFile(f *os.File) (bool, error) {
+	err := lockFileEx(f, lockfileExclusiveLock|lockfileFailImmediately)
+	if err == nil {
+		return true, nil
+	}
+	if errno, ok := err.(syscall.Errno); ok && errno == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
+
+func lockFileEx(f *os.File, flags uint32) error {
+	var overlapped syscall.Overlapped
+	r1, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r1 == 0 {
+		return err
+	}
+	return nil
+}
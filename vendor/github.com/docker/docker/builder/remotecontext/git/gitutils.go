@@ -1,6 +1,7 @@
 package git
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -8,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/pkg/symlink"
 	"github.com/docker/docker/pkg/urlutil"
@@ -23,34 +25,14 @@ type gitRepo struct {
 // Clone clones a repository into a newly created directory which
 // will be under "docker-build-git"
 func Clone(remoteURL string) (string, error) {
-	repo, err := parseRemoteURL(remoteURL)
-
-	if err != nil {
-		return "", err
-	}
-
-	fetch := fetchArgs(repo.remote, repo.ref)
-
-	root, err := ioutil.TempDir("", "docker-build-git")
-	if err != nil {
-		return "", err
-	}
-
-	if out, err := gitWithinDir(root, "init"); err != nil {
-		return "", errors.Wrapf(err, "failed to init repo at %s: %s", root, out)
-	}
-
-	// Add origin remote for compatibility with previous implementation that
-	// used "git clone" and also to make sure local refs are created for branches
-	if out, err := gitWithinDir(root, "remote", "add", "origin", repo.remote); err != nil {
-		return "", errors.Wrapf(err, "failed add origin repo at %s: %s", repo.remote, out)
-	}
-
-	if output, err := gitWithinDir(root, fetch...); err != nil {
-		return "", errors.Wrapf(err, "error fetching: %s", output)
-	}
+	return CloneContext(context.Background(), remoteURL)
+}
 
-	return checkoutGit(root, repo.ref, repo.subdir)
+// CloneContext is Clone with a context.Context that bounds the whole
+// operation: once it's done, any in-flight smart-HTTP probe, fetch, or
+// checkout is canceled instead of wedging the caller indefinitely.
+func CloneContext(ctx context.Context, remoteURL string) (string, error) {
+	return CloneContextWithOptions(ctx, remoteURL, CloneOptions{})
 }
 
 func parseRemoteURL(remoteURL string) (gitRepo, error) {
@@ -95,10 +77,13 @@ func getRefAndSubdir(fragment string) (ref string, subdir string) {
 	return
 }
 
-func fetchArgs(remoteURL string, ref string) []string {
-	args := []string{"fetch", "--recurse-submodules=yes"}
+func fetchArgs(ctx context.Context, remoteURL string, ref string, probeTimeout time.Duration, submodules SubmoduleMode) []string {
+	args := []string{"fetch"}
+	if submodules != SubmoduleNone {
+		args = append(args, "--recurse-submodules=yes")
+	}
 
-	if supportsShallowClone(remoteURL) {
+	if supportsShallowClone(ctx, remoteURL, probeTimeout) {
 		args = append(args, "--depth", "1")
 	}
 
@@ -107,17 +92,20 @@ func fetchArgs(remoteURL string, ref string) []string {
 
 // Check if a given git URL supports a shallow git clone,
 // i.e. it is a non-HTTP server or a smart HTTP server.
-func supportsShallowClone(remoteURL string) bool {
+func supportsShallowClone(ctx context.Context, remoteURL string, probeTimeout time.Duration) bool {
 	if urlutil.IsURL(remoteURL) {
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+
 		// Check if the HTTP server is smart
 
 		// Smart servers must correctly respond to a query for the git-upload-pack service
 		serviceURL := remoteURL + "/info/refs?service=git-upload-pack"
 
 		// Try a HEAD request and fallback to a Get request on error
-		res, err := http.Head(serviceURL)
+		res, err := probeHTTP(probeCtx, http.MethodHead, serviceURL)
 		if err != nil || res.StatusCode != http.StatusOK {
-			res, err = http.Get(serviceURL)
+			res, err = probeHTTP(probeCtx, http.MethodGet, serviceURL)
 			if err == nil {
 				res.Body.Close()
 			}
@@ -137,42 +125,235 @@ func supportsShallowClone(remoteURL string) bool {
 	return true
 }
 
-func checkoutGit(root, ref, subdir string) (string, error) {
+func probeHTTP(ctx context.Context, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// checkoutGit bounds the "checkout" step itself by opts.CheckoutTimeout,
+// then hands off to finalizeCheckout under the caller's own ctx so that
+// the submodule/LFS work finalizeCheckout does gets its own budget
+// instead of sharing the (deliberately short) checkout one.
+func checkoutGit(ctx context.Context, root, ref, subdir string, opts CloneOptions, env []string) (string, error) {
+	checkoutCtx, cancel := context.WithTimeout(ctx, withDefaultTimeout(opts.CheckoutTimeout, DefaultCheckoutTimeout))
+	defer cancel()
+
+	if err := configureSparseCheckout(checkoutCtx, root, opts.SparseCheckout); err != nil {
+		return "", err
+	}
+
 	// Try checking out by ref name first. This will work on branches and sets
 	// .git/HEAD to the current branch name
-	if output, err := gitWithinDir(root, "checkout", ref); err != nil {
+	if output, err := gitWithinDir(checkoutCtx, root, "checkout", ref); err != nil {
 		// If checking out by branch name fails check out the last fetched ref
-		if _, err2 := gitWithinDir(root, "checkout", "FETCH_HEAD"); err2 != nil {
+		if _, err2 := gitWithinDir(checkoutCtx, root, "checkout", "FETCH_HEAD"); err2 != nil {
 			return "", errors.Wrapf(err, "error checking out %s: %s", ref, output)
 		}
 	}
 
-	if subdir != "" {
-		newCtx, err := symlink.FollowSymlinkInScope(filepath.Join(root, subdir), root)
+	return finalizeCheckout(ctx, root, ref, subdir, opts, env)
+}
+
+// finalizeCheckout verifies a pinned commit (if any), initializes
+// submodules and pulls LFS objects per opts, strips .git unless KeepGitDir
+// is set, and resolves subdir. It's factored out of checkoutGit so that
+// Cache, which checks ref out itself via "git worktree add", can still
+// apply the same post-checkout policy. env carries the same credentials
+// prepareAuth built for the fetch, since submodule update and LFS pull are
+// themselves network operations against (typically) the same remote.
+func finalizeCheckout(ctx context.Context, root, ref, subdir string, opts CloneOptions, env []string) (string, error) {
+	if want := pinnedCommit(ref, opts); want != "" {
+		head, err := gitWithinDir(ctx, root, "rev-parse", "HEAD")
 		if err != nil {
-			return "", errors.Wrapf(err, "error setting git context, %q not within git root", subdir)
+			return "", errors.Wrapf(err, "error resolving HEAD after checking out %s", ref)
 		}
+		if got := strings.TrimSpace(string(head)); got != want {
+			return "", errors.Errorf("checked out commit %s does not match expected commit %s", got, want)
+		}
+	}
 
-		fi, err := os.Stat(newCtx)
-		if err != nil {
+	// Submodule update and LFS pull are genuinely slow, network-bound
+	// operations, like the initial fetch, not the quick local work the
+	// rest of this function does: give them FetchTimeout's (more generous)
+	// budget, still within the caller's ctx, instead of the checkout one.
+	fetchCtx, cancel := context.WithTimeout(ctx, withDefaultTimeout(opts.FetchTimeout, DefaultFetchTimeout))
+	defer cancel()
+
+	if opts.Submodules != SubmoduleNone {
+		args := []string{"submodule", "update", "--init"}
+		if opts.Submodules == SubmoduleRecursive {
+			args = append(args, "--recursive")
+		}
+		if out, err := gitWithinDirEnv(fetchCtx, root, env, args...); err != nil {
+			return "", errors.Wrapf(err, "error updating submodules: %s", redactSecrets(string(out), opts))
+		}
+	}
+
+	if opts.LFS {
+		if err := lfsPull(fetchCtx, root, opts.SparseCheckout, opts, env); err != nil {
 			return "", err
 		}
-		if !fi.IsDir() {
-			return "", errors.Errorf("error setting git context, not a directory: %s", newCtx)
+	}
+
+	if !opts.KeepGitDir {
+		if err := os.RemoveAll(filepath.Join(root, ".git")); err != nil {
+			return "", errors.Wrapf(err, "error removing .git at %s", root)
+		}
+	}
+
+	return applySubdir(root, subdir)
+}
+
+// configureSparseCheckout enables sparse-checkout and writes patterns to
+// info/sparse-checkout in root's git dir (.git itself, or the worktree's own
+// git dir under the mirror for a Cache worktree) before the checkout
+// happens, so the working tree it produces only ever materializes the
+// requested paths. It's a no-op when patterns is empty.
+func configureSparseCheckout(ctx context.Context, root string, patterns []string) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	if out, err := gitWithinDir(ctx, root, "config", "core.sparseCheckout", "true"); err != nil {
+		return errors.Wrapf(err, "error enabling sparse checkout: %s", out)
+	}
+
+	// In a Cache worktree .git is a file pointing elsewhere, not a directory.
+	gitDir, err := gitWithinDir(ctx, root, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return errors.Wrapf(err, "error resolving git dir of %s: %s", root, gitDir)
+	}
+	infoDir := filepath.Join(strings.TrimSpace(string(gitDir)), "info")
+	if err := os.MkdirAll(infoDir, 0755); err != nil {
+		return err
+	}
+	contents := strings.Join(patterns, "\n") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(infoDir, "sparse-checkout"), []byte(contents), 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+// lfsPull fetches LFS objects for the already-checked-out tree, narrowed
+// to paths when given, and returns a clear error if git-lfs isn't
+// installed rather than letting LFS pointer files silently pass through
+// as the file content. env carries the same credentials the fetch used,
+// since "lfs pull" talks to the remote itself.
+func lfsPull(ctx context.Context, root string, paths []string, opts CloneOptions, env []string) error {
+	if _, err := exec.LookPath("git-lfs"); err != nil {
+		return errors.New("LFS was requested for this build context but the git-lfs binary was not found on PATH")
+	}
+
+	if out, err := gitWithinDirEnv(ctx, root, env, "lfs", "install", "--local"); err != nil {
+		return errors.Wrapf(err, "error installing git-lfs in %s: %s", root, redactSecrets(string(out), opts))
+	}
+
+	args := []string{"lfs", "pull"}
+	if len(paths) != 0 {
+		args = append(args, "--include="+strings.Join(paths, ","))
+	}
+	if out, err := gitWithinDirEnv(ctx, root, env, args...); err != nil {
+		return errors.Wrapf(err, "error pulling LFS objects: %s", redactSecrets(string(out), opts))
+	}
+	return nil
+}
+
+// pinnedCommit returns the commit SHA checkoutGit must verify HEAD against,
+// or "" if the caller didn't pin one. opts.ExpectedCommit takes precedence
+// so that a caller fetching a mutable ref (e.g. refs/pull/42/head) can still
+// pin it to a known commit; otherwise, if ref itself is a full SHA, HEAD is
+// verified to match it byte-for-byte.
+func pinnedCommit(ref string, opts CloneOptions) string {
+	if opts.ExpectedCommit != "" {
+		return opts.ExpectedCommit
+	}
+	if isFullCommitSHA(ref) {
+		return ref
+	}
+	return ""
+}
+
+// isFullCommitSHA reports whether ref looks like a full, 40-character
+// hexadecimal git commit SHA rather than a branch or tag name.
+func isFullCommitSHA(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, r := range ref {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
 		}
-		root = newCtx
+	}
+	return true
+}
+
+// applySubdir resolves subdir (if any) against root, the same way
+// checkoutGit has always done, and returns the directory that should be
+// used as the build context. It is factored out of checkoutGit so that
+// Backend implementations other than execBackend can reuse it once they've
+// produced a checked-out worktree at root.
+func applySubdir(root, subdir string) (string, error) {
+	if subdir == "" {
+		return root, nil
 	}
 
-	return root, nil
+	newCtx, err := symlink.FollowSymlinkInScope(filepath.Join(root, subdir), root)
+	if err != nil {
+		return "", errors.Wrapf(err, "error setting git context, %q not within git root", subdir)
+	}
+
+	fi, err := os.Stat(newCtx)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", errors.Errorf("error setting git context, not a directory: %s", newCtx)
+	}
+
+	return newCtx, nil
+}
+
+func gitWithinDir(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	return gitWithinDirEnv(ctx, dir, nil, args...)
 }
 
-func gitWithinDir(dir string, args ...string) ([]byte, error) {
+// gitWithinDirEnv is gitWithinDir with additional environment variables
+// (e.g. GIT_SSH_COMMAND, GIT_CONFIG_KEY_n/GIT_CONFIG_VALUE_n) appended to
+// the child's environment, used to authenticate without putting secrets on
+// the command line.
+func gitWithinDirEnv(ctx context.Context, dir string, env []string, args ...string) ([]byte, error) {
 	a := []string{"--work-tree", dir, "--git-dir", filepath.Join(dir, ".git")}
-	return git(append(a, args...)...)
+	return gitEnv(ctx, env, append(a, args...)...)
 }
 
-func git(args ...string) ([]byte, error) {
-	return exec.Command("git", args...).CombinedOutput()
+// gitBareEnv runs git against a bare (or bare-mirror) repository at
+// gitDir, i.e. without a --work-tree, the way gitWithinDirEnv runs it
+// against a working copy. It's used for Cache's mirror repositories.
+func gitBareEnv(ctx context.Context, gitDir string, env []string, args ...string) ([]byte, error) {
+	a := []string{"--git-dir", gitDir}
+	return gitEnv(ctx, env, append(a, args...)...)
+}
+
+// gitCancelWaitDelay bounds how long a canceled git subprocess is given to
+// exit on its own (via SIGINT) before Go forcibly kills it (SIGKILL), once
+// its context is done.
+const gitCancelWaitDelay = 5 * time.Second
+
+func gitEnv(ctx context.Context, env []string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	if len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// Give git a chance to shut down cleanly on cancellation before the
+	// default post-WaitDelay SIGKILL lands.
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = gitCancelWaitDelay
+	return cmd.CombinedOutput()
 }
 
 // isGitTransport returns true if the provided str is a git transport by inspecting